@@ -0,0 +1,227 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileChunkStorePrefix names both a FileChunkStore upload's chunk file and,
+// with ".length" appended, the sidecar file its persisted total length (see
+// SetLength) is stored in.
+const fileChunkStorePrefix = "gqlgen-resumable-"
+
+// FileChunkStore is the default ChunkStore used by ResumableUpload. Each
+// upload is appended to a single file named after its Upload-Id under Dir.
+//
+// FileChunkStore never expires an upload on its own: a client that sends
+// one chunk and never returns leaves its file (and persisted length) on
+// disk indefinitely. Callers should run RemoveExpired periodically - e.g.
+// from a time.Ticker in a background goroutine - to bound the disk an
+// abandoned upload can hold onto.
+type FileChunkStore struct {
+	// Dir is the directory chunks are stored in. Defaults to os.TempDir.
+	Dir string
+}
+
+func (s FileChunkStore) dir() string {
+	if s.Dir == "" {
+		return os.TempDir()
+	}
+	return s.Dir
+}
+
+func (s FileChunkStore) path(id string) string {
+	return filepath.Join(s.dir(), fileChunkStorePrefix+filepath.Base(id))
+}
+
+func (s FileChunkStore) lengthPath(id string) string {
+	return s.path(id) + ".length"
+}
+
+func (s FileChunkStore) Offset(id string) (int64, error) {
+	info, err := os.Stat(s.path(id))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s FileChunkStore) Append(id string, data io.Reader) (int64, error) {
+	f, err := os.OpenFile(s.path(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, data); err != nil {
+		return 0, err
+	}
+	return f.Seek(0, io.SeekCurrent)
+}
+
+func (s FileChunkStore) Open(id string) (io.ReadCloser, error) {
+	return os.Open(s.path(id))
+}
+
+// SetLength persists the total length a client declared for id's upload,
+// unless one has already been recorded. tus clients send Upload-Length (and
+// raw Content-Range clients the total in its "/total" suffix) only on the
+// first chunk of an upload and omit it afterwards, trusting the server to
+// remember it - so the first call for a given id wins, and later ones are a
+// silent no-op rather than overwriting it.
+func (s FileChunkStore) SetLength(id string, length int64) error {
+	f, err := os.OpenFile(s.lengthPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(strconv.FormatInt(length, 10))
+	return err
+}
+
+// Length returns the length previously persisted by SetLength for id, and
+// whether one has been recorded yet.
+func (s FileChunkStore) Length(id string) (int64, bool, error) {
+	data, err := os.ReadFile(s.lengthPath(id))
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	n, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("transport: malformed persisted length for upload %s", id)
+	}
+	return n, true, nil
+}
+
+func (s FileChunkStore) Remove(id string) error {
+	if err := os.Remove(s.lengthPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err := os.Remove(s.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// RemoveExpired removes every upload under Dir whose chunk file hasn't been
+// written to in at least maxAge, along with its persisted length and
+// upload-id lock, so an abandoned upload doesn't hold disk space (or,
+// eventually, an unbounded uploadLocks entry) forever. FileChunkStore never
+// calls this itself; it's meant to be driven by a periodic sweep the
+// embedding application sets up alongside ResumableUpload.
+func (s FileChunkStore) RemoveExpired(maxAge time.Duration) error {
+	entries, err := os.ReadDir(s.dir())
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-maxAge)
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, fileChunkStorePrefix) || strings.HasSuffix(name, ".length") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			continue
+		}
+
+		id := strings.TrimPrefix(name, fileChunkStorePrefix)
+		unlock := lockUpload(id)
+		if err := s.Remove(id); err != nil {
+			unlock()
+			return err
+		}
+		forgetUploadLock(id)
+		unlock()
+	}
+	return nil
+}
+
+// uploadLocks serializes the offset-check-then-append sequence in
+// ResumableUpload.Do for a single upload id. ChunkStore's Offset and Append
+// are two separate calls with no critical section of their own spanning
+// them, so without this a retried or duplicated chunk racing the original
+// could both read the same offset and both append, corrupting the
+// assembled file with no error surfaced to either caller.
+var uploadLocks sync.Map // map[string]*sync.Mutex
+
+// lockUpload acquires the mutex for id, creating one on first use, and
+// returns a func that releases it.
+func lockUpload(id string) func() {
+	v, _ := uploadLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// forgetUploadLock discards id's entry in uploadLocks once its upload is
+// fully assembled and removed, so the map doesn't grow for the life of the
+// process. It must only be called while still holding id's lock.
+func forgetUploadLock(id string) {
+	uploadLocks.Delete(id)
+}
+
+// parseContentRangeStart extracts the starting byte offset from a
+// "bytes start-end/total" Content-Range header.
+func parseContentRangeStart(header string) (int64, error) {
+	spec, _, ok := strings.Cut(strings.TrimPrefix(header, "bytes "), "/")
+	if !ok {
+		return 0, fmt.Errorf("transport: malformed Content-Range header %q", header)
+	}
+	start, _, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, fmt.Errorf("transport: malformed Content-Range header %q", header)
+	}
+	return strconv.ParseInt(start, 10, 64)
+}
+
+// parseContentRangeTotal extracts the total size from a
+// "bytes start-end/total" Content-Range header. It returns -1 if the total
+// is the unknown marker "*".
+func parseContentRangeTotal(header string) (int64, error) {
+	_, total, ok := strings.Cut(strings.TrimPrefix(header, "bytes "), "/")
+	if !ok {
+		return 0, fmt.Errorf("transport: malformed Content-Range header %q", header)
+	}
+	if total == "*" {
+		return -1, nil
+	}
+	return strconv.ParseInt(total, 10, 64)
+}
+
+// readSeekCloserFrom asserts that a ChunkStore's assembled reader also
+// implements multipart.File, which graphql.Upload.File requires.
+// FileChunkStore.Open returns an *os.File, which qualifies; a ChunkStore
+// that can't provide a seekable handle isn't usable with ResumableUpload.
+func readSeekCloserFrom(r io.ReadCloser) (multipart.File, error) {
+	f, ok := r.(multipart.File)
+	if !ok {
+		return nil, fmt.Errorf("transport: ChunkStore.Open must return a seekable, ReaderAt-capable file")
+	}
+	return f, nil
+}
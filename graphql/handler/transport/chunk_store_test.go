@@ -0,0 +1,204 @@
+package transport
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileChunkStoreAppendAccumulatesOffset(t *testing.T) {
+	store := FileChunkStore{Dir: t.TempDir()}
+	const id = "upload-1"
+
+	if off, err := store.Offset(id); err != nil || off != 0 {
+		t.Fatalf("Offset before any chunk = (%d, %v), want (0, nil)", off, err)
+	}
+
+	off, err := store.Append(id, strings.NewReader("hello "))
+	if err != nil {
+		t.Fatalf("Append returned error: %v", err)
+	}
+	if off != 6 {
+		t.Fatalf("Append offset = %d, want 6", off)
+	}
+
+	off, err = store.Append(id, strings.NewReader("world"))
+	if err != nil {
+		t.Fatalf("Append returned error: %v", err)
+	}
+	if off != 11 {
+		t.Fatalf("Append offset = %d, want 11", off)
+	}
+
+	if off, err := store.Offset(id); err != nil || off != 11 {
+		t.Fatalf("Offset after both chunks = (%d, %v), want (11, nil)", off, err)
+	}
+
+	rc, err := store.Open(id)
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	defer rc.Close()
+
+	buf := make([]byte, 11)
+	if _, err := rc.Read(buf); err != nil {
+		t.Fatalf("Read returned error: %v", err)
+	}
+	if string(buf) != "hello world" {
+		t.Fatalf("assembled content = %q, want %q", buf, "hello world")
+	}
+
+	if err := store.Remove(id); err != nil {
+		t.Fatalf("Remove returned error: %v", err)
+	}
+	if off, err := store.Offset(id); err != nil || off != 0 {
+		t.Fatalf("Offset after Remove = (%d, %v), want (0, nil)", off, err)
+	}
+}
+
+func TestFileChunkStoreSetLengthFirstCallWins(t *testing.T) {
+	store := FileChunkStore{Dir: t.TempDir()}
+	const id = "upload-1"
+
+	if _, known, err := store.Length(id); err != nil || known {
+		t.Fatalf("Length before SetLength = (known=%v, err=%v), want (false, nil)", known, err)
+	}
+
+	if err := store.SetLength(id, 100); err != nil {
+		t.Fatalf("SetLength returned error: %v", err)
+	}
+	if err := store.SetLength(id, 200); err != nil {
+		t.Fatalf("second SetLength returned error: %v", err)
+	}
+
+	total, known, err := store.Length(id)
+	if err != nil {
+		t.Fatalf("Length returned error: %v", err)
+	}
+	if !known || total != 100 {
+		t.Fatalf("got (%d, %v), want the first-set (100, true) to have stuck", total, known)
+	}
+}
+
+func TestFileChunkStoreRemoveClearsPersistedLength(t *testing.T) {
+	store := FileChunkStore{Dir: t.TempDir()}
+	const id = "upload-1"
+
+	if err := store.SetLength(id, 100); err != nil {
+		t.Fatalf("SetLength returned error: %v", err)
+	}
+	if err := store.Remove(id); err != nil {
+		t.Fatalf("Remove returned error: %v", err)
+	}
+
+	if _, known, err := store.Length(id); err != nil || known {
+		t.Fatalf("Length after Remove = (known=%v, err=%v), want (false, nil)", known, err)
+	}
+}
+
+// TestFileChunkStoreRemoveExpiredSweepsAbandonedUploads checks that an
+// upload whose chunk file is older than maxAge is removed - along with its
+// persisted length and upload-id lock - while one within maxAge is left
+// alone, so a client that starts an upload and never finishes it doesn't
+// hold disk indefinitely.
+func TestFileChunkStoreRemoveExpiredSweepsAbandonedUploads(t *testing.T) {
+	store := FileChunkStore{Dir: t.TempDir()}
+	const staleID, freshID = "upload-stale", "upload-fresh"
+
+	for _, id := range []string{staleID, freshID} {
+		if _, err := store.Append(id, strings.NewReader("data")); err != nil {
+			t.Fatalf("Append(%s) returned error: %v", id, err)
+		}
+		if err := store.SetLength(id, 4096); err != nil {
+			t.Fatalf("SetLength(%s) returned error: %v", id, err)
+		}
+	}
+	lockUpload(staleID)()
+	lockUpload(freshID)()
+
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(store.path(staleID), old, old); err != nil {
+		t.Fatalf("Chtimes returned error: %v", err)
+	}
+
+	if err := store.RemoveExpired(time.Minute); err != nil {
+		t.Fatalf("RemoveExpired returned error: %v", err)
+	}
+
+	if off, err := store.Offset(staleID); err != nil || off != 0 {
+		t.Fatalf("stale upload Offset after sweep = (%d, %v), want (0, nil): it should have been removed", off, err)
+	}
+	if _, known, err := store.Length(staleID); err != nil || known {
+		t.Fatalf("stale upload Length after sweep = (known=%v, err=%v), want (false, nil)", known, err)
+	}
+	if _, loaded := uploadLocks.Load(staleID); loaded {
+		t.Fatal("stale upload's lock entry survived RemoveExpired")
+	}
+
+	if off, err := store.Offset(freshID); err != nil || off != 4 {
+		t.Fatalf("fresh upload Offset after sweep = (%d, %v), want (4, nil): it should have been left alone", off, err)
+	}
+	forgetUploadLock(freshID)
+}
+
+// TestLockUploadSerializesSameID spawns many goroutines holding the same
+// upload id's lock around a read-modify-write of a shared counter - the same
+// shape as Do's offset-check-then-append - and checks that no two of them
+// are ever inside the critical section at once.
+func TestLockUploadSerializesSameID(t *testing.T) {
+	const id = "upload-lock-test"
+	const goroutines = 50
+
+	var inCriticalSection int32
+	var maxObserved int32
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := lockUpload(id)
+			defer unlock()
+
+			mu.Lock()
+			inCriticalSection++
+			if inCriticalSection > maxObserved {
+				maxObserved = inCriticalSection
+			}
+			mu.Unlock()
+
+			mu.Lock()
+			inCriticalSection--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	forgetUploadLock(id)
+
+	if maxObserved != 1 {
+		t.Fatalf("observed %d goroutines in the critical section at once, want 1", maxObserved)
+	}
+}
+
+func TestLockUploadIndependentIDsDoNotBlockEachOther(t *testing.T) {
+	unlockA := lockUpload("upload-a")
+	defer unlockA()
+
+	done := make(chan struct{})
+	go func() {
+		unlockB := lockUpload("upload-b")
+		defer unlockB()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("lockUpload blocked on an unrelated upload id")
+	}
+	forgetUploadLock("upload-a")
+	forgetUploadLock("upload-b")
+}
@@ -1,10 +1,16 @@
 package transport
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"mime"
+	"mime/multipart"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/99designs/gqlgen/graphql"
 	"github.com/vektah/gqlparser/v2/gqlerror"
@@ -15,6 +21,47 @@ type MultipartForm struct {
 	// MaxUploadSize sets the maximum number of bytes used to parse a request body
 	// as multipart/form-data.
 	MaxUploadSize int64
+
+	// MaxFileUploadSize sets the maximum number of bytes, per file, allowed
+	// for files uploaded in a single multipart/form-data request. Defaults
+	// to MaxUploadSize if zero.
+	MaxFileUploadSize int64
+
+	// MaxNumberOfFiles sets the maximum number of file parts allowed in a
+	// single multipart/form-data request. Zero means no limit beyond
+	// MaxUploadSize.
+	MaxNumberOfFiles int
+
+	// MemoryBufferSize sets the maximum number of bytes, per file, used to
+	// buffer uploads in memory before spilling to disk. Only used when
+	// UploadStorage is nil. Defaults to 32KB.
+	MemoryBufferSize int64
+
+	// UploadStorage decides where uploaded files are held once read off the
+	// wire. Defaults to DefaultUploadStorage, which buffers small files in
+	// memory and spills larger ones to a temp file.
+	UploadStorage UploadStorage
+
+	// AllowedUploadContentTypes, when non-empty, restricts uploads to parts
+	// whose declared Content-Type header is in the list. Uploads with any
+	// other content type are rejected before being buffered.
+	AllowedUploadContentTypes []string
+
+	// UploadProcessors run, in order, over every uploaded file once it has
+	// been stored and before it is attached to the operation's variables.
+	// See UploadProcessor for what they can be used for.
+	UploadProcessors []UploadProcessor
+
+	// UploadSink, when set, streams uploaded files directly into object
+	// storage instead of buffering them with UploadStorage. See UploadSink.
+	UploadSink UploadSink
+
+	// RequireContentType rejects any file part that doesn't declare a
+	// Content-Type header, per the multipart request spec's recommendation.
+	RequireContentType bool
+
+	// RequireFilename rejects any file part that doesn't declare a filename.
+	RequireFilename bool
 }
 
 var _ graphql.Transport = MultipartForm{}
@@ -39,12 +86,47 @@ func (f MultipartForm) maxUploadSize() int64 {
 	return f.MaxUploadSize
 }
 
+func (f MultipartForm) maxFileUploadSize() int64 {
+	if f.MaxFileUploadSize == 0 {
+		return f.maxUploadSize()
+	}
+	return f.MaxFileUploadSize
+}
+
+func (f MultipartForm) uploadStorage() UploadStorage {
+	if f.UploadStorage == nil {
+		return DefaultUploadStorage{MemoryBufferSize: f.MemoryBufferSize}
+	}
+	return f.UploadStorage
+}
+
+func (f MultipartForm) contentTypeAllowed(contentType string) bool {
+	if len(f.AllowedUploadContentTypes) == 0 {
+		return true
+	}
+	for _, allowed := range f.AllowedUploadContentTypes {
+		if allowed == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// pendingUpload is a file part that has been read off the wire and stored,
+// waiting for the "map" part (which may arrive before or after it) to say
+// which operation variable(s) it belongs to.
+type pendingUpload struct {
+	file        multipart.File
+	size        int64
+	filename    string
+	contentType string
+}
+
 func (f MultipartForm) Do(w http.ResponseWriter, r *http.Request, exec graphql.GraphExecutor) {
 	w.Header().Set("Content-Type", "application/json")
 
 	start := graphql.Now()
 
-	var err error
 	if r.ContentLength > f.maxUploadSize() {
 		writeJsonError(w, "failed to parse multipart form, request body too large")
 		return
@@ -59,96 +141,411 @@ func (f MultipartForm) Do(w http.ResponseWriter, r *http.Request, exec graphql.G
 		return
 	}
 
-	part, err := mr.NextPart()
-	if err != nil || part.FormName() != "operations" {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		writeJsonError(w, "first part must be operations")
-		return
+	ctx, cleanupUploads := WithUploadCleanup(r.Context())
+	defer cleanupUploads()
+
+	storage := f.uploadStorage()
+	numFiles := 0
+
+	var presigner PresignedPutSink
+	presign := r.Header.Get("X-Upload-Presign") == "1"
+	if presign {
+		var ok bool
+		presigner, ok = f.UploadSink.(PresignedPutSink)
+		if !ok {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			writeJsonError(w, "this endpoint does not support pre-signed uploads")
+			return
+		}
 	}
+	presignedUploads := map[string]presignedUpload{}
 
-	var params graphql.RawParams
-	if err = jsonDecode(part, &params); err != nil {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		writeJsonError(w, "operations form field could not be decoded")
+	// The spec doesn't guarantee operations, map and the file parts arrive
+	// in that order, so every part is buffered until all of them have been
+	// seen and only then matched up against each other.
+	var operationsRaw []byte
+	var uploadsMap map[string][]string
+	pendingUploads := map[string]pendingUpload{}
+
+	// Objects streamed straight into an UploadSink are already committed by
+	// the time we find out whether the request as a whole is valid. If it
+	// isn't, remove anything we committed so a bad request can't leak
+	// storage.
+	var sinkKeys []string
+	uploadsCommitted := false
+	defer func() {
+		if uploadsCommitted {
+			return
+		}
+		if remover, ok := f.UploadSink.(UploadSinkRemover); ok {
+			for _, key := range sinkKeys {
+				remover.Remove(ctx, key) //nolint:errcheck // best-effort cleanup
+			}
+		}
+	}()
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			writeJsonErrorf(w, "failed to parse part")
+			return
+		}
+
+		switch part.FormName() {
+		case "operations":
+			operationsRaw, err = io.ReadAll(part)
+			if err != nil {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				writeJsonError(w, "operations form field could not be decoded")
+				return
+			}
+
+		case "map":
+			if err := json.NewDecoder(part).Decode(&uploadsMap); err != nil {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				writeJsonError(w, "map form field could not be decoded")
+				return
+			}
+
+		default:
+			key := part.FormName()
+			filename := part.FileName()
+			contentType := part.Header.Get("Content-Type")
+
+			if f.RequireContentType && contentType == "" {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				writeJsonErrorf(w, "part for key %s is missing a Content-Type header", key)
+				return
+			}
+			if f.RequireFilename && filename == "" {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				writeJsonErrorf(w, "part for key %s is missing a filename", key)
+				return
+			}
+			if !f.contentTypeAllowed(contentType) {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				writeJsonErrorf(w, "content type %s is not allowed for key %s", contentType, key)
+				return
+			}
+
+			numFiles++
+			if f.MaxNumberOfFiles != 0 && numFiles > f.MaxNumberOfFiles {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				writeJsonErrorf(w, "too many files uploaded, max is %d", f.MaxNumberOfFiles)
+				return
+			}
+
+			if presign {
+				io.Copy(io.Discard, part) //nolint:errcheck // the client isn't expected to send a body when pre-signing
+				url, objectKey, perr := presigner.PresignPut(ctx, filename, contentType)
+				if perr != nil {
+					w.WriteHeader(http.StatusUnprocessableEntity)
+					writeJsonErrorf(w, "failed to presign upload for key %s", key)
+					return
+				}
+				presignedUploads[key] = presignedUpload{URL: url, Key: objectKey}
+				continue
+			}
+
+			limited := io.LimitReader(part, f.maxFileUploadSize()+1)
+
+			var (
+				file multipart.File
+				size int64
+			)
+			if f.UploadSink != nil {
+				objectKey, n, serr := f.UploadSink.Put(ctx, filename, contentType, limited)
+				if serr != nil {
+					w.WriteHeader(http.StatusUnprocessableEntity)
+					writeJsonErrorf(w, "failed to store file for key %s", key)
+					return
+				}
+				size = n
+				file = &sinkFile{ctx: ctx, sink: f.UploadSink, key: objectKey}
+				sinkKeys = append(sinkKeys, objectKey)
+			} else {
+				var serr error
+				file, size, serr = storage.Store(ctx, filename, contentType, limited)
+				if serr != nil {
+					w.WriteHeader(http.StatusUnprocessableEntity)
+					writeJsonErrorf(w, "failed to store file for key %s", key)
+					return
+				}
+				if size > f.maxFileUploadSize() {
+					w.WriteHeader(http.StatusUnprocessableEntity)
+					writeJsonErrorf(w, "file for key %s exceeds the maximum upload size", key)
+					return
+				}
+
+				var perr error
+				file, size, perr = f.runUploadProcessors(ctx, file, filename, contentType)
+				if perr != nil {
+					w.WriteHeader(http.StatusUnprocessableEntity)
+					if gerr, ok := perr.(*gqlerror.Error); ok {
+						writeJsonGraphqlError(w, gerr)
+					} else {
+						writeJsonErrorf(w, "failed to process file for key %s", key)
+					}
+					return
+				}
+			}
+			if size > f.maxFileUploadSize() {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				writeJsonErrorf(w, "file for key %s exceeds the maximum upload size", key)
+				return
+			}
+
+			pendingUploads[key] = pendingUpload{
+				file:        file,
+				size:        size,
+				filename:    filename,
+				contentType: contentType,
+			}
+		}
+	}
+
+	if presign {
+		json.NewEncoder(w).Encode(struct { //nolint:errcheck // best-effort, the connection is what it is by this point
+			Uploads map[string]presignedUpload `json:"uploads"`
+		}{Uploads: presignedUploads})
 		return
 	}
 
-	part, err = mr.NextPart()
-	if err != nil || part.FormName() != "map" {
+	if operationsRaw == nil {
 		w.WriteHeader(http.StatusUnprocessableEntity)
-		writeJsonError(w, "second part must be map")
+		writeJsonError(w, "request is missing the operations part")
 		return
 	}
-
-	uploadsMap := map[string][]string{}
-	if err = json.NewDecoder(part).Decode(&uploadsMap); err != nil {
+	if uploadsMap == nil {
 		w.WriteHeader(http.StatusUnprocessableEntity)
-		writeJsonError(w, "map form field could not be decoded")
+		writeJsonError(w, "request is missing the map part")
 		return
 	}
 
-	for {
-		part, err = mr.NextPart()
-		if err == io.EOF {
-			break
-		} else if err != nil {
+	batch := bytes.HasPrefix(bytes.TrimSpace(operationsRaw), []byte("["))
+
+	var opParams []*graphql.RawParams
+	if batch {
+		var raw []graphql.RawParams
+		if err := json.Unmarshal(operationsRaw, &raw); err != nil {
 			w.WriteHeader(http.StatusUnprocessableEntity)
-			writeJsonErrorf(w, "failed to parse part")
+			writeJsonError(w, "operations form field could not be decoded")
 			return
 		}
+		opParams = make([]*graphql.RawParams, len(raw))
+		for i := range raw {
+			opParams[i] = &raw[i]
+		}
+	} else {
+		var p graphql.RawParams
+		if err := json.Unmarshal(operationsRaw, &p); err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			writeJsonError(w, "operations form field could not be decoded")
+			return
+		}
+		opParams = []*graphql.RawParams{&p}
+	}
 
-		key := part.FormName()
-		filename := part.FileName()
-		contentType := part.Header.Get("Content-Type")
+	for key, paths := range uploadsMap {
+		pu, ok := pendingUploads[key]
+		if !ok {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			writeJsonErrorf(w, "failed to get key %s from form", key)
+			return
+		}
+		delete(pendingUploads, key)
 
-		paths := uploadsMap[key]
 		if len(paths) == 0 {
 			w.WriteHeader(http.StatusUnprocessableEntity)
 			writeJsonErrorf(w, "invalid empty operations paths list for key %s", key)
 			return
 		}
-		delete(uploadsMap, key)
 
-		var (
-			upload graphql.Upload
-			err    *gqlerror.Error
-		)
 		for _, path := range paths {
-			upload = graphql.Upload{
-				File:        part,
-				Size:        r.ContentLength,
-				Filename:    filename,
-				ContentType: contentType,
+			opIndex, varPath, verr := resolveUploadPath(path, batch, len(opParams))
+			if verr != nil {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				writeJsonErrorf(w, "invalid map path %q for key %s: %s", path, key, verr)
+				return
+			}
+			if verr := validateUploadPath(opParams[opIndex], varPath); verr != nil {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				writeJsonErrorf(w, "map path %q for key %s does not match an operation variable: %s", path, key, verr)
+				return
 			}
 
-			if err = params.AddUpload(upload, key, path); err != nil {
+			upload := graphql.Upload{
+				File:        pu.file,
+				Size:        pu.size,
+				Filename:    pu.filename,
+				ContentType: pu.contentType,
+			}
+			if gerr := opParams[opIndex].AddUpload(upload, key, varPath); gerr != nil {
 				w.WriteHeader(http.StatusUnprocessableEntity)
-				writeJsonGraphqlError(w, err)
+				writeJsonGraphqlError(w, gerr)
 				return
 			}
 		}
 	}
 
-	for key := range uploadsMap {
+	for key := range pendingUploads {
 		w.WriteHeader(http.StatusUnprocessableEntity)
-		writeJsonErrorf(w, "failed to get key %s from form", key)
+		writeJsonErrorf(w, "file for key %s was not referenced by the map", key)
 		return
 	}
+	uploadsCommitted = true
 
-	params.Headers = r.Header
+	if !batch {
+		p := opParams[0]
+		p.Headers = r.Header
+		p.ReadTime = graphql.TraceTiming{Start: start, End: graphql.Now()}
 
-	params.ReadTime = graphql.TraceTiming{
-		Start: start,
-		End:   graphql.Now(),
+		rc, gerr := exec.CreateOperationContext(ctx, p)
+		if gerr != nil {
+			resp := exec.DispatchError(graphql.WithOperationContext(ctx, rc), gerr)
+			w.WriteHeader(statusFor(gerr))
+			writeJson(w, resp)
+			return
+		}
+		responses, opCtx := exec.DispatchOperation(ctx, rc)
+		if acceptsMultipartMixedDeferSpec(r) {
+			writeMultipartMixedResponse(opCtx, w, responses)
+			return
+		}
+		writeJson(w, responses(opCtx))
+		return
 	}
 
-	rc, gerr := exec.CreateOperationContext(r.Context(), &params)
-	if gerr != nil {
-		resp := exec.DispatchError(graphql.WithOperationContext(r.Context(), rc), gerr)
-		w.WriteHeader(statusFor(gerr))
-		writeJson(w, resp)
+	if acceptsMultipartMixedDeferSpec(r) {
+		// Chain every operation's response generator into one, so @defer/
+		// @stream payloads from a batched operation stream out as their own
+		// parts instead of being dropped the way a single writeJson call
+		// would drop them.
+		opIndex := 0
+		var responses func(context.Context) *graphql.Response
+		var opCtx context.Context
+		next := func(context.Context) *graphql.Response {
+			for {
+				if responses != nil {
+					if resp := responses(opCtx); resp != nil {
+						return resp
+					}
+					responses = nil
+				}
+				if opIndex >= len(opParams) {
+					return nil
+				}
+
+				p := opParams[opIndex]
+				opIndex++
+				p.Headers = r.Header
+				p.ReadTime = graphql.TraceTiming{Start: start, End: graphql.Now()}
+
+				rc, gerr := exec.CreateOperationContext(ctx, p)
+				if gerr != nil {
+					return exec.DispatchError(graphql.WithOperationContext(ctx, rc), gerr)
+				}
+				responses, opCtx = exec.DispatchOperation(ctx, rc)
+			}
+		}
+		writeMultipartMixedResponse(ctx, w, next)
 		return
 	}
-	responses, ctx := exec.DispatchOperation(r.Context(), rc)
-	writeJson(w, responses(ctx))
+
+	// The client didn't ask for incremental delivery, so there's nowhere to
+	// put more than one response per operation in the JSON array below;
+	// drain each operation's generator fully (rather than discarding it
+	// after the first call) and keep its last response.
+	batchResponses := make([]*graphql.Response, len(opParams))
+	for i, p := range opParams {
+		p.Headers = r.Header
+		p.ReadTime = graphql.TraceTiming{Start: start, End: graphql.Now()}
+
+		rc, gerr := exec.CreateOperationContext(ctx, p)
+		if gerr != nil {
+			batchResponses[i] = exec.DispatchError(graphql.WithOperationContext(ctx, rc), gerr)
+			continue
+		}
+		responses, opCtx := exec.DispatchOperation(ctx, rc)
+		for {
+			resp := responses(opCtx)
+			if resp == nil {
+				break
+			}
+			batchResponses[i] = resp
+		}
+	}
+	json.NewEncoder(w).Encode(batchResponses) //nolint:errcheck // best-effort, the connection is what it is by this point
+}
+
+// resolveUploadPath splits a map entry's path into the operation it targets
+// and the remaining path into that operation's variables. For a single
+// (non-batched) operation the whole path is the variable path; for a
+// batched one the path must be prefixed with the operation's index, e.g.
+// "1.variables.file".
+func resolveUploadPath(path string, batch bool, numOps int) (int, string, error) {
+	if !batch {
+		return 0, path, nil
+	}
+
+	idx, rest, ok := strings.Cut(path, ".")
+	if !ok {
+		return 0, "", fmt.Errorf(`batched uploads must be addressed as "<operation index>.<path>"`)
+	}
+	i, err := strconv.Atoi(idx)
+	if err != nil || i < 0 || i >= numOps {
+		return 0, "", fmt.Errorf("operation index %q is out of range for %d operations", idx, numOps)
+	}
+	return i, rest, nil
+}
+
+// validateUploadPath checks that a map entry's variable path (e.g.
+// "variables.input.file") resolves to a real location within params'
+// variables, so that a typo'd path fails with a precise error instead of
+// silently being ignored.
+func validateUploadPath(params *graphql.RawParams, path string) error {
+	segments := strings.Split(path, ".")
+	if len(segments) == 0 || segments[0] != "variables" {
+		return fmt.Errorf(`path must start with "variables"`)
+	}
+	segments = segments[1:]
+	if len(segments) == 0 {
+		return fmt.Errorf("path must reference a variable")
+	}
+
+	var cur interface{} = params.Variables
+	for i, seg := range segments {
+		last := i == len(segments)-1
+
+		switch v := cur.(type) {
+		case map[string]interface{}:
+			next, ok := v[seg]
+			if !ok {
+				if last {
+					// The leaf segment is allowed to be absent: the map's
+					// whole job is to create it with the upload's value.
+					return nil
+				}
+				return fmt.Errorf("unknown variable path segment %q", seg)
+			}
+			cur = next
+
+		case []interface{}:
+			idx, err := strconv.Atoi(seg)
+			if err != nil || idx < 0 || idx >= len(v) {
+				return fmt.Errorf("invalid array index %q", seg)
+			}
+			cur = v[idx]
+
+		default:
+			if last {
+				return nil
+			}
+			return fmt.Errorf("cannot descend into %q", seg)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,432 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+func TestResolveUploadPathSingleOperation(t *testing.T) {
+	idx, rest, err := resolveUploadPath("variables.file", false, 1)
+	if err != nil {
+		t.Fatalf("resolveUploadPath returned error: %v", err)
+	}
+	if idx != 0 || rest != "variables.file" {
+		t.Fatalf("got (%d, %q), want (0, %q)", idx, rest, "variables.file")
+	}
+}
+
+func TestResolveUploadPathBatched(t *testing.T) {
+	idx, rest, err := resolveUploadPath("1.variables.file", true, 2)
+	if err != nil {
+		t.Fatalf("resolveUploadPath returned error: %v", err)
+	}
+	if idx != 1 || rest != "variables.file" {
+		t.Fatalf("got (%d, %q), want (1, %q)", idx, rest, "variables.file")
+	}
+}
+
+func TestResolveUploadPathBatchedMissingIndex(t *testing.T) {
+	if _, _, err := resolveUploadPath("variables.file", true, 2); err == nil {
+		t.Fatal("expected error for batched path without an operation index, got nil")
+	}
+}
+
+func TestResolveUploadPathBatchedIndexOutOfRange(t *testing.T) {
+	if _, _, err := resolveUploadPath("2.variables.file", true, 2); err == nil {
+		t.Fatal("expected error for out-of-range operation index, got nil")
+	}
+}
+
+func TestValidateUploadPathNestedMapAndArray(t *testing.T) {
+	params := &graphql.RawParams{
+		Variables: map[string]interface{}{
+			"input": map[string]interface{}{
+				"attachments": []interface{}{
+					map[string]interface{}{"file": nil},
+					map[string]interface{}{"file": nil},
+				},
+			},
+		},
+	}
+
+	if err := validateUploadPath(params, "variables.input.attachments.1.file"); err != nil {
+		t.Fatalf("validateUploadPath returned error: %v", err)
+	}
+}
+
+func TestValidateUploadPathAllowsAbsentLeaf(t *testing.T) {
+	params := &graphql.RawParams{
+		Variables: map[string]interface{}{
+			"input": map[string]interface{}{},
+		},
+	}
+
+	if err := validateUploadPath(params, "variables.input.file"); err != nil {
+		t.Fatalf("validateUploadPath returned error for absent leaf: %v", err)
+	}
+}
+
+func TestValidateUploadPathRejectsUnknownSegment(t *testing.T) {
+	params := &graphql.RawParams{
+		Variables: map[string]interface{}{
+			"input": map[string]interface{}{},
+		},
+	}
+
+	if err := validateUploadPath(params, "variables.input.nested.file"); err == nil {
+		t.Fatal("expected error for path through a missing non-leaf segment, got nil")
+	}
+}
+
+func TestValidateUploadPathRejectsOutOfRangeArrayIndex(t *testing.T) {
+	params := &graphql.RawParams{
+		Variables: map[string]interface{}{
+			"files": []interface{}{nil},
+		},
+	}
+
+	if err := validateUploadPath(params, "variables.files.5"); err == nil {
+		t.Fatal("expected error for out-of-range array index, got nil")
+	}
+}
+
+func TestValidateUploadPathRejectsMissingVariablesPrefix(t *testing.T) {
+	params := &graphql.RawParams{Variables: map[string]interface{}{}}
+
+	if err := validateUploadPath(params, "input.file"); err == nil {
+		t.Fatal("expected error for path not starting with \"variables\", got nil")
+	}
+}
+
+// formPart is one part of a multipart/form-data body built by
+// newMultipartFormRequest: either a text field (operations, map) when
+// filename is empty, or a file part otherwise.
+type formPart struct {
+	name        string
+	filename    string
+	contentType string
+	data        []byte
+}
+
+func newMultipartFormRequest(t *testing.T, parts []formPart, headers map[string]string) *http.Request {
+	t.Helper()
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, p := range parts {
+		h := make(textproto.MIMEHeader)
+		if p.filename != "" {
+			h.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, p.name, p.filename))
+		} else {
+			h.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q`, p.name))
+		}
+		if p.contentType != "" {
+			h.Set("Content-Type", p.contentType)
+		}
+		pw, err := mw.CreatePart(h)
+		if err != nil {
+			t.Fatalf("CreatePart returned error: %v", err)
+		}
+		if _, err := pw.Write(p.data); err != nil {
+			t.Fatalf("writing part %s returned error: %v", p.name, err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("closing multipart writer returned error: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/graphql", &buf)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return r
+}
+
+func operationsPart(query string) formPart {
+	return formPart{name: "operations", data: []byte(fmt.Sprintf(`{"query":%q,"variables":{"file":null}}`, query))}
+}
+
+func batchedOperationsPart(queries ...string) formPart {
+	var ops []string
+	for _, q := range queries {
+		ops = append(ops, fmt.Sprintf(`{"query":%q,"variables":{"file":null}}`, q))
+	}
+	return formPart{name: "operations", data: []byte("[" + strings.Join(ops, ",") + "]")}
+}
+
+func mapPart(body string) formPart {
+	return formPart{name: "map", data: []byte(body)}
+}
+
+// fakeExecutor is a minimal graphql.GraphExecutor that records every
+// operation it was asked to create and returns a canned response for it.
+// It keys captured RawParams off the *graphql.OperationContext pointer it
+// hands back, rather than relying on any of that struct's fields, since
+// MultipartForm only ever uses it as an opaque token.
+type fakeExecutor struct {
+	mu       sync.Mutex
+	captured []*graphql.RawParams
+	byRC     map[*graphql.OperationContext]*graphql.RawParams
+}
+
+func (e *fakeExecutor) CreateOperationContext(ctx context.Context, params *graphql.RawParams) (*graphql.OperationContext, gqlerror.List) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.captured = append(e.captured, params)
+	if e.byRC == nil {
+		e.byRC = map[*graphql.OperationContext]*graphql.RawParams{}
+	}
+	rc := &graphql.OperationContext{}
+	e.byRC[rc] = params
+	return rc, nil
+}
+
+func (e *fakeExecutor) DispatchOperation(ctx context.Context, rc *graphql.OperationContext) (graphql.ResponseHandler, context.Context) {
+	sent := false
+	return func(context.Context) *graphql.Response {
+		if sent {
+			return nil
+		}
+		sent = true
+		return &graphql.Response{Data: json.RawMessage(`{"ok":true}`)}
+	}, ctx
+}
+
+func (e *fakeExecutor) DispatchError(ctx context.Context, errs gqlerror.List) *graphql.Response {
+	return &graphql.Response{Errors: errs}
+}
+
+func (e *fakeExecutor) operationCount() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.captured)
+}
+
+// fakeUploadSink is an in-memory UploadSinkRemover/PresignedPutSink used to
+// exercise MultipartForm's commit/rollback and presign paths without
+// touching real object storage.
+type fakeUploadSink struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	removed []string
+}
+
+func (s *fakeUploadSink) Put(ctx context.Context, filename, contentType string, src io.Reader) (string, int64, error) {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return "", 0, err
+	}
+	s.mu.Lock()
+	if s.objects == nil {
+		s.objects = map[string][]byte{}
+	}
+	s.objects[filename] = data
+	s.mu.Unlock()
+	return filename, int64(len(data)), nil
+}
+
+func (s *fakeUploadSink) Get(ctx context.Context, key string) (multipart.File, error) {
+	s.mu.Lock()
+	data, ok := s.objects[key]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("fakeUploadSink: no object %s", key)
+	}
+	return memoryFile{Reader: bytes.NewReader(data)}, nil
+}
+
+func (s *fakeUploadSink) Remove(ctx context.Context, key string) error {
+	s.mu.Lock()
+	delete(s.objects, key)
+	s.removed = append(s.removed, key)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *fakeUploadSink) PresignPut(ctx context.Context, filename, contentType string) (string, string, error) {
+	return "https://storage.example/" + filename, "presigned-" + filename, nil
+}
+
+func TestMultipartFormDoRejectsMissingContentTypeWhenRequired(t *testing.T) {
+	f := MultipartForm{RequireContentType: true}
+	r := newMultipartFormRequest(t, []formPart{
+		{name: "file", filename: "a.txt", data: []byte("hi")},
+	}, nil)
+	w := httptest.NewRecorder()
+
+	f.Do(w, r, &fakeExecutor{})
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestMultipartFormDoRejectsMissingFilenameWhenRequired(t *testing.T) {
+	f := MultipartForm{RequireFilename: true}
+	r := newMultipartFormRequest(t, []formPart{
+		{name: "file", contentType: "text/plain", data: []byte("hi")},
+	}, nil)
+	w := httptest.NewRecorder()
+
+	f.Do(w, r, &fakeExecutor{})
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestMultipartFormDoRejectsDisallowedContentType(t *testing.T) {
+	f := MultipartForm{AllowedUploadContentTypes: []string{"image/png"}}
+	r := newMultipartFormRequest(t, []formPart{
+		{name: "file", filename: "a.txt", contentType: "text/plain", data: []byte("hi")},
+	}, nil)
+	w := httptest.NewRecorder()
+
+	f.Do(w, r, &fakeExecutor{})
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestMultipartFormDoRejectsTooManyFiles(t *testing.T) {
+	f := MultipartForm{MaxNumberOfFiles: 1}
+	r := newMultipartFormRequest(t, []formPart{
+		{name: "a", filename: "a.txt", contentType: "text/plain", data: []byte("1")},
+		{name: "b", filename: "b.txt", contentType: "text/plain", data: []byte("2")},
+	}, nil)
+	w := httptest.NewRecorder()
+
+	f.Do(w, r, &fakeExecutor{})
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestMultipartFormDoDispatchesSingleOperation(t *testing.T) {
+	f := MultipartForm{}
+	exec := &fakeExecutor{}
+	r := newMultipartFormRequest(t, []formPart{
+		operationsPart("mutation($file: Upload!){ upload(file: $file) }"),
+		mapPart(`{"file":["variables.file"]}`),
+		{name: "file", filename: "a.txt", contentType: "text/plain", data: []byte("hello")},
+	}, nil)
+	w := httptest.NewRecorder()
+
+	f.Do(w, r, exec)
+
+	if exec.operationCount() != 1 {
+		t.Fatalf("executor received %d operations, want 1", exec.operationCount())
+	}
+}
+
+func TestMultipartFormDoDispatchesBatchedOperations(t *testing.T) {
+	f := MultipartForm{}
+	exec := &fakeExecutor{}
+	r := newMultipartFormRequest(t, []formPart{
+		batchedOperationsPart(
+			"mutation($file: Upload!){ upload(file: $file) }",
+			"mutation($file: Upload!){ upload(file: $file) }",
+		),
+		mapPart(`{"file":["0.variables.file"]}`),
+		{name: "file", filename: "a.txt", contentType: "text/plain", data: []byte("hello")},
+	}, nil)
+	w := httptest.NewRecorder()
+
+	f.Do(w, r, exec)
+
+	if exec.operationCount() != 2 {
+		t.Fatalf("executor received %d operations, want 2: both batched operations should dispatch even though only the first references the upload", exec.operationCount())
+	}
+}
+
+func TestMultipartFormDoCommitsSinkUploadOnSuccess(t *testing.T) {
+	sink := &fakeUploadSink{}
+	f := MultipartForm{UploadSink: sink}
+	exec := &fakeExecutor{}
+	r := newMultipartFormRequest(t, []formPart{
+		operationsPart("mutation($file: Upload!){ upload(file: $file) }"),
+		mapPart(`{"file":["variables.file"]}`),
+		{name: "file", filename: "a.txt", contentType: "text/plain", data: []byte("hello")},
+	}, nil)
+	w := httptest.NewRecorder()
+
+	f.Do(w, r, exec)
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.removed) != 0 {
+		t.Fatalf("sink.Remove called for %v after a successful dispatch, want no rollback", sink.removed)
+	}
+	if _, ok := sink.objects["a.txt"]; !ok {
+		t.Fatal("committed object a.txt is gone from the sink")
+	}
+}
+
+func TestMultipartFormDoRollsBackSinkUploadNotReferencedByMap(t *testing.T) {
+	sink := &fakeUploadSink{}
+	f := MultipartForm{UploadSink: sink}
+	exec := &fakeExecutor{}
+	r := newMultipartFormRequest(t, []formPart{
+		operationsPart("mutation($file: Upload!){ upload(file: $file) }"),
+		mapPart(`{}`),
+		{name: "file", filename: "a.txt", contentType: "text/plain", data: []byte("hello")},
+	}, nil)
+	w := httptest.NewRecorder()
+
+	f.Do(w, r, exec)
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.removed) != 1 || sink.removed[0] != "a.txt" {
+		t.Fatalf("sink.removed = %v, want [a.txt]: an uncommitted object must be rolled back", sink.removed)
+	}
+}
+
+func TestMultipartFormDoPresignReturnsUploadURLWithoutDispatching(t *testing.T) {
+	sink := &fakeUploadSink{}
+	f := MultipartForm{UploadSink: sink}
+	exec := &fakeExecutor{}
+	r := newMultipartFormRequest(t, []formPart{
+		{name: "file", filename: "a.txt", contentType: "text/plain", data: nil},
+	}, map[string]string{"X-Upload-Presign": "1"})
+	w := httptest.NewRecorder()
+
+	f.Do(w, r, exec)
+
+	if exec.operationCount() != 0 {
+		t.Fatalf("executor received %d operations, want 0: a presign request never dispatches an operation", exec.operationCount())
+	}
+
+	var body struct {
+		Uploads map[string]presignedUpload `json:"uploads"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("response body could not be decoded: %v", err)
+	}
+	got, ok := body.Uploads["file"]
+	if !ok {
+		t.Fatal(`response is missing the "file" key`)
+	}
+	if got.URL != "https://storage.example/a.txt" || got.Key != "presigned-a.txt" {
+		t.Fatalf("got %+v, want the URL/key fakeUploadSink.PresignPut returned", got)
+	}
+}
@@ -0,0 +1,275 @@
+package transport
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/99designs/gqlgen/graphql"
+)
+
+// ChunkStore persists the bytes of a partial upload between requests, keyed
+// by the Upload-Id the client sends on every chunk of the same upload. The
+// zero value of FileChunkStore is the default used by ResumableUpload.
+//
+// ResumableUpload.Do serializes Offset and Append for a given id itself, so
+// a ChunkStore implementation doesn't need to guard against concurrent
+// chunks for the same upload on its own.
+type ChunkStore interface {
+	// Offset returns the number of bytes already stored for id, or 0 if
+	// nothing has been stored yet.
+	Offset(id string) (int64, error)
+
+	// Append writes data at the end of the chunks already stored for id and
+	// returns the new total offset.
+	Append(id string, data io.Reader) (int64, error)
+
+	// Open returns a reader over everything stored for id, for use once the
+	// final chunk has arrived. The caller is responsible for closing it.
+	Open(id string) (io.ReadCloser, error)
+
+	// SetLength persists the total length declared for id's upload, unless
+	// one has already been recorded for it. Real tus clients only send the
+	// length on an upload's first chunk and rely on the server to remember
+	// it for the rest, so ResumableUpload calls this once up front instead
+	// of expecting every chunk's request to repeat it.
+	SetLength(id string, length int64) error
+
+	// Length returns the length previously recorded by SetLength for id,
+	// and whether one has been recorded yet.
+	Length(id string) (int64, bool, error)
+
+	// Remove discards everything stored for id. Called once the assembled
+	// upload has been dispatched, successfully or not.
+	Remove(id string) error
+}
+
+// ResumableUpload is a transport.Transport that accepts an upload spread
+// across multiple chunked requests, using either the tus resumable upload
+// protocol (https://tus.io/protocols/resumable-upload) or raw HTTP
+// Content-Range semantics. Once the final chunk arrives, it assembles the
+// stored chunks into a single graphql.Upload and dispatches the GraphQL
+// operation carried in the final chunk's Upload-Operations header; the
+// operation, filename, content type and upload path are all read from that
+// final request, not from earlier chunks.
+//
+// Unlike MultipartForm, which requires the whole file to arrive in a single
+// request body, ResumableUpload lets a client resume an interrupted upload
+// of a multi-GB file from wherever it left off.
+type ResumableUpload struct {
+	// Store persists partial uploads between chunks. Defaults to a
+	// FileChunkStore rooted at os.TempDir.
+	Store ChunkStore
+
+	// MaxUploadSize is the maximum total size, across all chunks, allowed
+	// for a single upload.
+	MaxUploadSize int64
+}
+
+var _ graphql.Transport = ResumableUpload{}
+
+func (f ResumableUpload) Supports(r *http.Request) bool {
+	if r.Method != http.MethodPost && r.Method != http.MethodPatch {
+		return false
+	}
+	return r.Header.Get("Upload-Id") != ""
+}
+
+func (f ResumableUpload) store() ChunkStore {
+	if f.Store == nil {
+		return FileChunkStore{}
+	}
+	return f.Store
+}
+
+func (f ResumableUpload) maxUploadSize() int64 {
+	if f.MaxUploadSize == 0 {
+		return 32 << 20
+	}
+	return f.MaxUploadSize
+}
+
+func (f ResumableUpload) Do(w http.ResponseWriter, r *http.Request, exec graphql.GraphExecutor) {
+	w.Header().Set("Content-Type", "application/json")
+
+	start := graphql.Now()
+
+	uploadID := r.Header.Get("Upload-Id")
+	store := f.store()
+
+	// Holds until this chunk is fully handled, so the offset this chunk
+	// reads and the offset it appends at can't be invalidated by another
+	// chunk for the same upload racing it in between.
+	unlock := lockUpload(uploadID)
+	defer unlock()
+
+	offset, err := store.Offset(uploadID)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		writeJsonErrorf(w, "failed to look up upload %s", uploadID)
+		return
+	}
+
+	clientOffset, offsetGiven, err := expectedOffset(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJsonErrorf(w, "malformed offset for upload %s", uploadID)
+		return
+	}
+	switch {
+	case offsetGiven && clientOffset != offset:
+		w.WriteHeader(http.StatusConflict)
+		writeJsonErrorf(w, "upload %s is at offset %d, not %d", uploadID, offset, clientOffset)
+		return
+	case !offsetGiven && offset != 0:
+		// Every chunk after the first must say where it picks up; without
+		// that we can't tell a resumed upload from a duplicated request.
+		w.WriteHeader(http.StatusBadRequest)
+		writeJsonErrorf(w, "upload %s requires an Upload-Offset or Content-Range header after the first chunk", uploadID)
+		return
+	}
+
+	total, totalKnown, err := uploadTotalLength(store, uploadID, r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJsonErrorf(w, "malformed length for upload %s", uploadID)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, f.maxUploadSize()-offset)
+	defer r.Body.Close()
+
+	newOffset, err := store.Append(uploadID, body)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		writeJsonErrorf(w, "failed to store chunk for upload %s", uploadID)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+
+	if !isFinalChunk(newOffset, total, totalKnown) {
+		w.Header().Set("Location", r.URL.String())
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	defer store.Remove(uploadID)
+	defer forgetUploadLock(uploadID)
+
+	reader, err := store.Open(uploadID)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		writeJsonErrorf(w, "failed to assemble upload %s", uploadID)
+		return
+	}
+	defer reader.Close()
+
+	var params graphql.RawParams
+	if err := json.Unmarshal([]byte(r.Header.Get("Upload-Operations")), &params); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		writeJsonError(w, "Upload-Operations header could not be decoded")
+		return
+	}
+
+	filename := r.Header.Get("Upload-Filename")
+	contentType := r.Header.Get("Upload-Content-Type")
+	if contentType == "" {
+		contentType, _, _ = mime.ParseMediaType(r.Header.Get("Content-Type"))
+	}
+
+	assembledFile, err := readSeekCloserFrom(reader)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		writeJsonErrorf(w, "failed to assemble upload %s", uploadID)
+		return
+	}
+
+	upload := graphql.Upload{
+		File:        assembledFile,
+		Size:        newOffset,
+		Filename:    filename,
+		ContentType: contentType,
+	}
+	if gerr := params.AddUpload(upload, "file", r.Header.Get("Upload-Path")); gerr != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		writeJsonGraphqlError(w, gerr)
+		return
+	}
+
+	params.Headers = r.Header
+	params.ReadTime = graphql.TraceTiming{
+		Start: start,
+		End:   graphql.Now(),
+	}
+
+	rc, gerr := exec.CreateOperationContext(r.Context(), &params)
+	if gerr != nil {
+		resp := exec.DispatchError(graphql.WithOperationContext(r.Context(), rc), gerr)
+		w.WriteHeader(statusFor(gerr))
+		writeJson(w, resp)
+		return
+	}
+	responses, ctx := exec.DispatchOperation(r.Context(), rc)
+	writeJson(w, responses(ctx))
+}
+
+// expectedOffset reads the offset the client believes the upload to be at,
+// from either the tus Upload-Offset header or a Content-Range request
+// header. The second return value reports whether either header was present
+// at all, since a missing header is only acceptable on an upload's first
+// chunk.
+func expectedOffset(r *http.Request) (int64, bool, error) {
+	if v := r.Header.Get("Upload-Offset"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		return n, true, err
+	}
+	if v := r.Header.Get("Content-Range"); v != "" {
+		n, err := parseContentRangeStart(v)
+		return n, true, err
+	}
+	return 0, false, nil
+}
+
+// uploadTotalLength determines the declared total size of upload id. A tus
+// client sends Upload-Length (or a raw Content-Range client its "/total"
+// suffix) only on the chunk that creates the upload and omits it from every
+// chunk after that, trusting the server to remember it - so whichever of
+// this request or store.SetLength's prior callers saw it first wins, via
+// store.Length.
+func uploadTotalLength(store ChunkStore, id string, r *http.Request) (int64, bool, error) {
+	if total, known, err := store.Length(id); err != nil {
+		return 0, false, err
+	} else if known {
+		// Once a length has been declared, later chunks can't override it -
+		// otherwise a malicious or buggy client could redeclare the total
+		// mid-upload to force (or indefinitely delay) completion.
+		return total, true, nil
+	}
+
+	if v := r.Header.Get("Upload-Length"); v != "" {
+		total, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, false, err
+		}
+		return total, true, store.SetLength(id, total)
+	}
+	if v := r.Header.Get("Content-Range"); v != "" {
+		total, err := parseContentRangeTotal(v)
+		if err != nil {
+			return 0, false, err
+		}
+		if total >= 0 {
+			return total, true, store.SetLength(id, total)
+		}
+	}
+	return 0, false, nil
+}
+
+// isFinalChunk reports whether this chunk completes the upload: whether a
+// total length has been declared at all, for either this chunk or an
+// earlier one (see uploadTotalLength), and whether newOffset has reached it.
+func isFinalChunk(newOffset, total int64, totalKnown bool) bool {
+	return totalKnown && newOffset >= total
+}
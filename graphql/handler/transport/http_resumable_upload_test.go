@@ -0,0 +1,143 @@
+package transport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExpectedOffsetFromUploadOffsetHeader(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPatch, "/", nil)
+	r.Header.Set("Upload-Offset", "42")
+
+	off, given, err := expectedOffset(r)
+	if err != nil {
+		t.Fatalf("expectedOffset returned error: %v", err)
+	}
+	if !given || off != 42 {
+		t.Fatalf("got (%d, %v), want (42, true)", off, given)
+	}
+}
+
+func TestExpectedOffsetFromContentRangeHeader(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPatch, "/", nil)
+	r.Header.Set("Content-Range", "bytes 100-199/200")
+
+	off, given, err := expectedOffset(r)
+	if err != nil {
+		t.Fatalf("expectedOffset returned error: %v", err)
+	}
+	if !given || off != 100 {
+		t.Fatalf("got (%d, %v), want (100, true)", off, given)
+	}
+}
+
+func TestExpectedOffsetAbsentOnFirstChunk(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+
+	off, given, err := expectedOffset(r)
+	if err != nil {
+		t.Fatalf("expectedOffset returned error: %v", err)
+	}
+	if given || off != 0 {
+		t.Fatalf("got (%d, %v), want (0, false)", off, given)
+	}
+}
+
+func TestIsFinalChunk(t *testing.T) {
+	if isFinalChunk(99, 100, true) {
+		t.Fatal("isFinalChunk = true for an offset short of the total")
+	}
+	if !isFinalChunk(100, 100, true) {
+		t.Fatal("isFinalChunk = false for an offset matching the total")
+	}
+	if isFinalChunk(100, 100, false) {
+		t.Fatal("isFinalChunk = true with no total known yet")
+	}
+}
+
+func TestUploadTotalLengthFromUploadLengthHeader(t *testing.T) {
+	store := FileChunkStore{Dir: t.TempDir()}
+	r := httptest.NewRequest(http.MethodPatch, "/", nil)
+	r.Header.Set("Upload-Length", "100")
+
+	total, known, err := uploadTotalLength(store, "upload-1", r)
+	if err != nil {
+		t.Fatalf("uploadTotalLength returned error: %v", err)
+	}
+	if !known || total != 100 {
+		t.Fatalf("got (%d, %v), want (100, true)", total, known)
+	}
+}
+
+func TestUploadTotalLengthFromContentRangeHeader(t *testing.T) {
+	store := FileChunkStore{Dir: t.TempDir()}
+	r := httptest.NewRequest(http.MethodPatch, "/", nil)
+	r.Header.Set("Content-Range", "bytes 50-99/100")
+
+	total, known, err := uploadTotalLength(store, "upload-1", r)
+	if err != nil {
+		t.Fatalf("uploadTotalLength returned error: %v", err)
+	}
+	if !known || total != 100 {
+		t.Fatalf("got (%d, %v), want (100, true)", total, known)
+	}
+}
+
+func TestUploadTotalLengthUnknownContentRangeTotal(t *testing.T) {
+	store := FileChunkStore{Dir: t.TempDir()}
+	r := httptest.NewRequest(http.MethodPatch, "/", nil)
+	r.Header.Set("Content-Range", "bytes 50-99/*")
+
+	_, known, err := uploadTotalLength(store, "upload-1", r)
+	if err != nil {
+		t.Fatalf("uploadTotalLength returned error: %v", err)
+	}
+	if known {
+		t.Fatal("uploadTotalLength reported a known total for an unknown (\"*\") Content-Range total")
+	}
+}
+
+// TestUploadTotalLengthPersistsAcrossChunksWithoutHeader is the interop
+// scenario real tus clients rely on: Upload-Length is only sent once, on
+// the chunk that creates the upload, and every chunk after that omits it.
+func TestUploadTotalLengthPersistsAcrossChunksWithoutHeader(t *testing.T) {
+	store := FileChunkStore{Dir: t.TempDir()}
+	const id = "upload-1"
+
+	first := httptest.NewRequest(http.MethodPost, "/", nil)
+	first.Header.Set("Upload-Length", "100")
+	if _, known, err := uploadTotalLength(store, id, first); err != nil || !known {
+		t.Fatalf("first chunk: got known=%v, err=%v, want known=true, err=nil", known, err)
+	}
+
+	later := httptest.NewRequest(http.MethodPatch, "/", nil)
+	total, known, err := uploadTotalLength(store, id, later)
+	if err != nil {
+		t.Fatalf("later chunk: uploadTotalLength returned error: %v", err)
+	}
+	if !known || total != 100 {
+		t.Fatalf("later chunk: got (%d, %v), want (100, true)", total, known)
+	}
+}
+
+func TestUploadTotalLengthFirstDeclarationWins(t *testing.T) {
+	store := FileChunkStore{Dir: t.TempDir()}
+	const id = "upload-1"
+
+	first := httptest.NewRequest(http.MethodPost, "/", nil)
+	first.Header.Set("Upload-Length", "100")
+	if _, _, err := uploadTotalLength(store, id, first); err != nil {
+		t.Fatalf("first chunk: uploadTotalLength returned error: %v", err)
+	}
+
+	conflicting := httptest.NewRequest(http.MethodPatch, "/", nil)
+	conflicting.Header.Set("Upload-Length", "200")
+	total, known, err := uploadTotalLength(store, id, conflicting)
+	if err != nil {
+		t.Fatalf("uploadTotalLength returned error: %v", err)
+	}
+	if !known || total != 100 {
+		t.Fatalf("got (%d, %v), want the first-declared (100, true) to win over a later chunk's conflicting header", total, known)
+	}
+}
@@ -0,0 +1,78 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/99designs/gqlgen/graphql"
+)
+
+const multipartMixedBoundary = "graphql"
+
+// acceptsMultipartMixedDeferSpec reports whether the client advertised
+// support for the incremental delivery response format via
+// Accept: multipart/mixed; deferSpec=20220824, the convention Apollo Client
+// and Relay use to consume @defer/@stream responses.
+func acceptsMultipartMixedDeferSpec(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			if mediaType == "multipart/mixed" && params["deferspec"] == "20220824" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeMultipartMixedResponse streams every response produced by next as its
+// own part of a multipart/mixed body, flushing after each one, so that
+// @defer/@stream payloads reach the client as they become available instead
+// of only once dispatch finishes. It is shared by any transport that
+// dispatches an operation and wants to honour the deferSpec Accept header.
+// It does not look at the Accept header itself: callers check
+// acceptsMultipartMixedDeferSpec and use writeJson when the client didn't ask
+// for this format. When w doesn't implement http.Flusher, it writes only
+// next's first response, as a single plain JSON body.
+func writeMultipartMixedResponse(ctx context.Context, w http.ResponseWriter, next func(context.Context) *graphql.Response) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJson(w, next(ctx))
+		return
+	}
+
+	w.Header().Set("Content-Type", fmt.Sprintf(`multipart/mixed; boundary="%s"`, multipartMixedBoundary))
+	w.WriteHeader(http.StatusOK)
+
+	bw := bufio.NewWriter(w)
+	for {
+		resp := next(ctx)
+		if resp == nil {
+			break
+		}
+
+		body, err := json.Marshal(resp)
+		if err != nil {
+			return
+		}
+
+		fmt.Fprintf(bw, "--%s\r\n", multipartMixedBoundary)
+		fmt.Fprint(bw, "Content-Type: application/json\r\n\r\n")
+		bw.Write(body)
+		fmt.Fprint(bw, "\r\n")
+		bw.Flush()
+		flusher.Flush()
+	}
+
+	fmt.Fprintf(bw, "--%s--\r\n", multipartMixedBoundary)
+	bw.Flush()
+	flusher.Flush()
+}
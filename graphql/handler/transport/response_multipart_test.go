@@ -0,0 +1,118 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/99designs/gqlgen/graphql"
+)
+
+func TestAcceptsMultipartMixedDeferSpec(t *testing.T) {
+	cases := []struct {
+		name   string
+		accept string
+		want   bool
+	}{
+		{"exact match", `multipart/mixed; deferSpec=20220824`, true},
+		{"among other values", `application/json, multipart/mixed; deferSpec=20220824`, true},
+		{"wrong deferSpec", `multipart/mixed; deferSpec=19990101`, false},
+		{"no deferSpec param", `multipart/mixed`, false},
+		{"plain json only", `application/json`, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			r.Header.Set("Accept", c.accept)
+			if got := acceptsMultipartMixedDeferSpec(r); got != c.want {
+				t.Fatalf("acceptsMultipartMixedDeferSpec(%q) = %v, want %v", c.accept, got, c.want)
+			}
+		})
+	}
+}
+
+// TestWriteMultipartMixedResponseStreamsEachPart feeds a fixed sequence of
+// responses through next and checks that every one lands in its own
+// multipart part, in order, with the terminating boundary at the end - the
+// same contract a batched operation's chained next (http_form.go) depends
+// on to avoid dropping @defer/@stream payloads.
+func TestWriteMultipartMixedResponseStreamsEachPart(t *testing.T) {
+	responses := []*graphql.Response{
+		{Data: json.RawMessage(`{"first":1}`)},
+		{Data: json.RawMessage(`{"second":2}`)},
+	}
+	i := 0
+	next := func(context.Context) *graphql.Response {
+		if i >= len(responses) {
+			return nil
+		}
+		resp := responses[i]
+		i++
+		return resp
+	}
+
+	w := httptest.NewRecorder()
+	writeMultipartMixedResponse(context.Background(), w, next)
+
+	ct := w.Header().Get("Content-Type")
+	if !strings.HasPrefix(ct, "multipart/mixed;") {
+		t.Fatalf("Content-Type = %q, want a multipart/mixed prefix", ct)
+	}
+
+	body := w.Body.String()
+	parts := []string{`{"first":1}`, `{"second":2}`}
+	lastIdx := -1
+	for _, p := range parts {
+		idx := strings.Index(body, p)
+		if idx == -1 {
+			t.Fatalf("body missing part %q; body was:\n%s", p, body)
+		}
+		if idx < lastIdx {
+			t.Fatalf("part %q appeared out of order; body was:\n%s", p, body)
+		}
+		lastIdx = idx
+	}
+
+	if !strings.HasSuffix(strings.TrimRight(body, "\r\n"), "--"+multipartMixedBoundary+"--") {
+		t.Fatalf("body missing terminating boundary; body was:\n%s", body)
+	}
+	if got := strings.Count(body, "--"+multipartMixedBoundary); got != len(parts)+1 {
+		t.Fatalf("found %d boundary markers, want %d (one per part plus the terminator)", got, len(parts)+1)
+	}
+}
+
+// TestWriteMultipartMixedResponseFallsBackWithoutFlusher checks that a
+// ResponseWriter lacking http.Flusher gets a single plain JSON response
+// instead of a (silently unflushed) multipart body.
+func TestWriteMultipartMixedResponseFallsBackWithoutFlusher(t *testing.T) {
+	w := &nonFlushingResponseWriter{header: http.Header{}}
+	called := false
+	next := func(context.Context) *graphql.Response {
+		if called {
+			return nil
+		}
+		called = true
+		return &graphql.Response{Data: json.RawMessage(`{"only":1}`)}
+	}
+
+	writeMultipartMixedResponse(context.Background(), w, next)
+
+	if ct := w.Header().Get("Content-Type"); strings.Contains(ct, "multipart/mixed") {
+		t.Fatalf("Content-Type = %q, want no multipart/mixed fallback header", ct)
+	}
+	if !strings.Contains(w.body.String(), `"only":1`) {
+		t.Fatalf("body = %q, want it to contain the single response", w.body.String())
+	}
+}
+
+type nonFlushingResponseWriter struct {
+	header http.Header
+	body   strings.Builder
+}
+
+func (w *nonFlushingResponseWriter) Header() http.Header         { return w.header }
+func (w *nonFlushingResponseWriter) Write(p []byte) (int, error) { return w.body.Write(p) }
+func (w *nonFlushingResponseWriter) WriteHeader(int)             {}
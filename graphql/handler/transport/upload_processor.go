@@ -0,0 +1,274 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// UploadProcessor is invoked for every uploaded file part once it has been
+// fully buffered by UploadStorage but before it is attached to the
+// operation's variables. Processors are chained in configuration order,
+// each receiving the previous one's output, which makes them a convenient
+// place to plug in virus scanning, metadata scrubbing, or content-type
+// verification without forking MultipartForm.
+//
+// Returning a *gqlerror.Error rejects the upload with that error surfaced
+// to the client (mapped to a 422 response); any other error is reported as
+// a generic failure.
+type UploadProcessor interface {
+	Process(ctx context.Context, filename, contentType string, file io.ReadSeeker) (io.ReadSeeker, error)
+}
+
+// EXIFStripper is an UploadProcessor that removes EXIF metadata - including
+// GPS coordinates - from uploaded JPEG and TIFF files. For JPEG it drops the
+// APP1 segment, where EXIF lives; for TIFF, where EXIF and GPS data are
+// regular tags in the image's own IFD, it removes the Exif IFD Pointer
+// (0x8769) and GPS IFD Pointer (0x8825) entries so nothing reaches that
+// metadata through the directory it hands back. Files of any other content
+// type are passed through unchanged.
+type EXIFStripper struct{}
+
+var _ UploadProcessor = EXIFStripper{}
+
+func (EXIFStripper) Process(ctx context.Context, filename, contentType string, file io.ReadSeeker) (io.ReadSeeker, error) {
+	var strip func([]byte) ([]byte, error)
+	switch contentType {
+	case "image/jpeg":
+		strip = stripJPEGExif
+	case "image/tiff":
+		strip = stripTIFFExif
+	default:
+		return file, nil
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	stripped, err := strip(data)
+	if err != nil {
+		// Not a well-formed file of its declared type: leave the bytes
+		// untouched rather than fail an upload over a bad content type.
+		return bytes.NewReader(data), nil
+	}
+	return bytes.NewReader(stripped), nil
+}
+
+// stripJPEGExif walks a JPEG's marker segments and drops any APP1 segment,
+// which is where EXIF (and XMP) metadata lives.
+func stripJPEGExif(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, fmt.Errorf("transport: not a JPEG file")
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, data[0], data[1])
+
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			break
+		}
+		marker := data[i+1]
+		if marker == 0xD8 || marker == 0xD9 || (marker >= 0xD0 && marker <= 0xD7) {
+			out = append(out, data[i], data[i+1])
+			i += 2
+			continue
+		}
+
+		segLen := int(data[i+2])<<8 | int(data[i+3])
+		if i+2+segLen > len(data) {
+			return nil, fmt.Errorf("transport: truncated JPEG segment")
+		}
+
+		if marker == 0xE1 {
+			i += 2 + segLen
+			continue
+		}
+
+		out = append(out, data[i:i+2+segLen]...)
+		i += 2 + segLen
+
+		if marker == 0xDA {
+			// Start of scan: the rest of the file is compressed image data.
+			out = append(out, data[i:]...)
+			return out, nil
+		}
+	}
+	out = append(out, data[i:]...)
+	return out, nil
+}
+
+// TIFF tags that point at the sub-IFDs EXIF and GPS metadata live in.
+const (
+	tiffExifIFDTag = 0x8769
+	tiffGPSIFDTag  = 0x8825
+)
+
+// stripTIFFExif removes the Exif IFD Pointer and GPS IFD Pointer entries
+// from every IFD in a TIFF file. The sub-IFDs those tags pointed at are left
+// in place in the returned bytes (relocating them would mean rewriting
+// every other offset in the file), but since nothing references them
+// anymore a reader walking the directory never reaches them.
+func stripTIFFExif(data []byte) ([]byte, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("transport: not a TIFF file")
+	}
+
+	var order binary.ByteOrder
+	switch string(data[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("transport: not a TIFF file")
+	}
+	if order.Uint16(data[2:4]) != 42 {
+		return nil, fmt.Errorf("transport: not a TIFF file")
+	}
+
+	out := make([]byte, len(data))
+	copy(out, data)
+
+	ifdOffset := order.Uint32(data[4:8])
+	for ifdOffset != 0 {
+		if int64(ifdOffset)+2 > int64(len(data)) {
+			return nil, fmt.Errorf("transport: IFD offset out of range")
+		}
+		numEntries := int(order.Uint16(data[ifdOffset : ifdOffset+2]))
+		entriesStart := int64(ifdOffset) + 2
+		entriesEnd := entriesStart + int64(numEntries)*12
+		if entriesEnd+4 > int64(len(data)) {
+			return nil, fmt.Errorf("transport: IFD entries out of range")
+		}
+
+		kept := 0
+		for i := 0; i < numEntries; i++ {
+			entryOff := entriesStart + int64(i)*12
+			tag := order.Uint16(data[entryOff : entryOff+2])
+			if tag == tiffExifIFDTag || tag == tiffGPSIFDTag {
+				continue
+			}
+			dst := entriesStart + int64(kept)*12
+			if dst != entryOff {
+				copy(out[dst:dst+12], data[entryOff:entryOff+12])
+			}
+			kept++
+		}
+		order.PutUint16(out[ifdOffset:ifdOffset+2], uint16(kept))
+
+		next := order.Uint32(data[entriesEnd : entriesEnd+4])
+		nextOffsetPos := entriesStart + int64(kept)*12
+		order.PutUint32(out[nextOffsetPos:nextOffsetPos+4], next)
+
+		ifdOffset = next
+	}
+
+	return out, nil
+}
+
+// ContentTypeSniffer is an UploadProcessor that rejects a part whose
+// declared Content-Type doesn't agree with what http.DetectContentType
+// finds by sniffing the first 512 bytes, guarding against files that lie
+// about their type to slip past naive extension or header checks.
+type ContentTypeSniffer struct{}
+
+var _ UploadProcessor = ContentTypeSniffer{}
+
+func (ContentTypeSniffer) Process(ctx context.Context, filename, contentType string, file io.ReadSeeker) (io.ReadSeeker, error) {
+	sniff := make([]byte, 512)
+	n, err := io.ReadFull(file, sniff)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	sniff = sniff[:n]
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	detected := http.DetectContentType(sniff)
+	if !contentTypeMatches(detected, contentType) {
+		return nil, gqlerror.Errorf("declared content type %s for %s does not match detected type %s", contentType, filename, detected)
+	}
+	return file, nil
+}
+
+// runUploadProcessors feeds file through f.UploadProcessors in order and
+// re-wraps the final result as a multipart.File, seeked back to the start,
+// along with its (possibly changed) size.
+func (f MultipartForm) runUploadProcessors(ctx context.Context, file multipart.File, filename, contentType string) (multipart.File, int64, error) {
+	var rs io.ReadSeeker = file
+	for _, proc := range f.UploadProcessors {
+		var err error
+		rs, err = proc.Process(ctx, filename, contentType, rs)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+
+	mf, err := asMultipartFile(rs)
+	if err != nil {
+		return nil, 0, err
+	}
+	return mf, size, nil
+}
+
+// asMultipartFile adapts an io.ReadSeeker - the type UploadProcessor deals
+// in, since processors may rewrap the data in something that isn't directly
+// a multipart.File - back into the multipart.File that graphql.Upload.File
+// requires. A *bytes.Reader (what EXIFStripper and most processors return)
+// already has a real, concurrency-safe ReadAt, so it's wrapped as-is; any
+// other io.ReadSeeker is fully buffered into one, rather than synthesizing
+// ReadAt from Seek+Read, which isn't safe for concurrent callers and can
+// return short reads without an error.
+func asMultipartFile(rs io.ReadSeeker) (multipart.File, error) {
+	if f, ok := rs.(multipart.File); ok {
+		return f, nil
+	}
+	if br, ok := rs.(*bytes.Reader); ok {
+		return memoryFile{Reader: br}, nil
+	}
+
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(rs)
+	if err != nil {
+		return nil, err
+	}
+	return memoryFile{Reader: bytes.NewReader(data)}, nil
+}
+
+func contentTypeMatches(detected, declared string) bool {
+	detectedMedia, _, _ := mime.ParseMediaType(detected)
+	declaredMedia, _, _ := mime.ParseMediaType(declared)
+	if detectedMedia == declaredMedia {
+		return true
+	}
+	// http.DetectContentType can't tell text subtypes apart; accept its
+	// generic text/plain guess for any declared text/* type.
+	if detectedMedia == "text/plain" && strings.HasPrefix(declaredMedia, "text/") {
+		return true
+	}
+	return false
+}
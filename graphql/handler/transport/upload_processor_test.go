@@ -0,0 +1,182 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// jpegWithAPP1 builds a minimal well-formed JPEG with an APP1 (Exif) segment
+// right after SOI, followed by an untouched COM segment and the start of
+// scan, so a strip can be checked against exactly the bytes it's supposed to
+// remove.
+func jpegWithAPP1() []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0xFF, 0xD8}) // SOI
+
+	// APP1 "Exif\x00\x00", length 8 (2 length bytes + 6 payload bytes).
+	buf.Write([]byte{0xFF, 0xE1, 0x00, 0x08})
+	buf.WriteString("Exif\x00\x00")
+
+	// COM "test", length 6 (2 length bytes + 4 payload bytes). Not EXIF, so
+	// it must survive the strip untouched.
+	buf.Write([]byte{0xFF, 0xFE, 0x00, 0x06})
+	buf.WriteString("test")
+
+	// SOS, length 2 (no scan header payload in this fixture), followed by
+	// fake compressed scan data and EOI.
+	buf.Write([]byte{0xFF, 0xDA, 0x00, 0x02})
+	buf.Write([]byte{0x12, 0x34, 0xFF, 0xD9})
+
+	return buf.Bytes()
+}
+
+func TestStripJPEGExifRemovesAPP1(t *testing.T) {
+	out, err := stripJPEGExif(jpegWithAPP1())
+	if err != nil {
+		t.Fatalf("stripJPEGExif returned error: %v", err)
+	}
+
+	want := []byte{0xFF, 0xD8}
+	want = append(want, []byte{0xFF, 0xFE, 0x00, 0x06}...)
+	want = append(want, "test"...)
+	want = append(want, []byte{0xFF, 0xDA, 0x00, 0x02}...)
+	want = append(want, []byte{0x12, 0x34, 0xFF, 0xD9}...)
+
+	if !bytes.Equal(out, want) {
+		t.Fatalf("stripJPEGExif = %x, want %x", out, want)
+	}
+	if bytes.Contains(out, []byte("Exif")) {
+		t.Fatalf("stripJPEGExif left EXIF payload in output: %x", out)
+	}
+}
+
+func TestStripJPEGExifRejectsNonJPEG(t *testing.T) {
+	if _, err := stripJPEGExif([]byte("not a jpeg")); err == nil {
+		t.Fatal("expected error for non-JPEG input, got nil")
+	}
+}
+
+func TestStripJPEGExifRejectsTruncatedSegment(t *testing.T) {
+	data := []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x10, 0x00} // claims 16 bytes, has 1
+	if _, err := stripJPEGExif(data); err == nil {
+		t.Fatal("expected error for truncated segment, got nil")
+	}
+}
+
+// tiffWithIFD builds a minimal little-endian TIFF with one IFD containing an
+// Exif IFD Pointer, a GPS IFD Pointer, and one unrelated tag, so a strip can
+// be checked against exactly the two pointer entries it's supposed to drop.
+func tiffWithIFD() []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{'I', 'I'})               // little-endian byte order
+	buf.Write([]byte{0x2A, 0x00})             // magic 42
+	buf.Write([]byte{0x08, 0x00, 0x00, 0x00}) // first IFD at offset 8
+
+	buf.Write([]byte{0x03, 0x00}) // 3 entries
+
+	// Tag 0x0100 (ImageWidth), type SHORT, count 1, value 100 - kept.
+	buf.Write([]byte{0x00, 0x01, 0x03, 0x00, 0x01, 0x00, 0x00, 0x00, 0x64, 0x00, 0x00, 0x00})
+	// Tag 0x8769 (Exif IFD Pointer) - dropped.
+	buf.Write([]byte{0x69, 0x87, 0x04, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	// Tag 0x8825 (GPS IFD Pointer) - dropped.
+	buf.Write([]byte{0x25, 0x88, 0x04, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+
+	buf.Write([]byte{0x00, 0x00, 0x00, 0x00}) // next IFD offset: none
+
+	return buf.Bytes()
+}
+
+func TestStripTIFFExifRemovesPointerTags(t *testing.T) {
+	data := tiffWithIFD()
+	out, err := stripTIFFExif(data)
+	if err != nil {
+		t.Fatalf("stripTIFFExif returned error: %v", err)
+	}
+
+	numEntries := int(out[8]) | int(out[9])<<8
+	if numEntries != 1 {
+		t.Fatalf("got %d IFD entries after strip, want 1", numEntries)
+	}
+
+	entryOff := 10
+	tag := uint16(out[entryOff]) | uint16(out[entryOff+1])<<8
+	if tag != 0x0100 {
+		t.Fatalf("surviving entry has tag %#x, want 0x0100", tag)
+	}
+}
+
+func TestStripTIFFExifRejectsNonTIFF(t *testing.T) {
+	if _, err := stripTIFFExif([]byte("not a tiff")); err == nil {
+		t.Fatal("expected error for non-TIFF input, got nil")
+	}
+}
+
+func TestContentTypeSnifferAcceptsMatchingType(t *testing.T) {
+	png := []byte{0x89, 'P', 'N', 'G', 0x0D, 0x0A, 0x1A, 0x0A}
+	file := bytes.NewReader(png)
+
+	out, err := ContentTypeSniffer{}.Process(context.Background(), "icon.png", "image/png", file)
+	if err != nil {
+		t.Fatalf("Process returned error: %v", err)
+	}
+
+	got, err := readAllAndRewind(out)
+	if err != nil {
+		t.Fatalf("reading the returned file failed: %v", err)
+	}
+	if !bytes.Equal(got, png) {
+		t.Fatalf("Process returned content %x, want the original %x untouched", got, png)
+	}
+}
+
+func TestContentTypeSnifferRejectsMismatchedType(t *testing.T) {
+	png := []byte{0x89, 'P', 'N', 'G', 0x0D, 0x0A, 0x1A, 0x0A}
+	file := bytes.NewReader(png)
+
+	_, err := ContentTypeSniffer{}.Process(context.Background(), "fake.pdf", "application/pdf", file)
+	if err == nil {
+		t.Fatal("expected an error for a declared type that doesn't match the sniffed content, got nil")
+	}
+	if _, ok := err.(*gqlerror.Error); !ok {
+		t.Fatalf("error has type %T, want *gqlerror.Error so it surfaces to the client instead of failing generically", err)
+	}
+}
+
+func TestContentTypeSnifferAcceptsAnyTextSubtypeForSniffedPlainText(t *testing.T) {
+	// http.DetectContentType can only ever guess the generic "text/plain"
+	// for text content, so a declared text/csv (or any other text/*) has to
+	// be accepted against that generic guess rather than rejected.
+	csv := []byte("a,b,c\n1,2,3\n")
+	file := bytes.NewReader(csv)
+
+	out, err := ContentTypeSniffer{}.Process(context.Background(), "data.csv", "text/csv", file)
+	if err != nil {
+		t.Fatalf("Process returned error for a text/* declared type: %v", err)
+	}
+
+	got, err := readAllAndRewind(out)
+	if err != nil {
+		t.Fatalf("reading the returned file failed: %v", err)
+	}
+	if !bytes.Equal(got, csv) {
+		t.Fatalf("Process returned content %q, want %q", got, csv)
+	}
+}
+
+// readAllAndRewind reads an io.ReadSeeker from its current position to the
+// end, so it sees the whole content only if Process returned it rewound to
+// its start, then rewinds it again for any later reader.
+func readAllAndRewind(rs io.ReadSeeker) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(rs); err != nil {
+		return nil, err
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
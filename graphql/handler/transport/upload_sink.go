@@ -0,0 +1,121 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"mime/multipart"
+	"sync"
+)
+
+// UploadSink streams an uploaded file part straight into object storage
+// (S3, GCS, ...) instead of buffering it on the GraphQL server, for
+// deployments where paying for that buffering twice is wasteful. When
+// MultipartForm.UploadSink is set, it is used in place of UploadStorage, and
+// UploadProcessors are skipped since running them would require reading the
+// bytes back anyway.
+type UploadSink interface {
+	// Put streams src into storage under a key of the implementation's
+	// choosing (derived from filename) and returns that key and the number
+	// of bytes written, once the object is fully committed - e.g. after
+	// S3's CompleteMultipartUpload.
+	Put(ctx context.Context, filename, contentType string, src io.Reader) (key string, size int64, err error)
+
+	// Get returns a reader over the object previously stored under key. It
+	// backs the lazy graphql.Upload.File handed to resolvers, so the bytes
+	// are only fetched from storage if and when something actually reads
+	// them.
+	Get(ctx context.Context, key string) (multipart.File, error)
+}
+
+// UploadSinkRemover is an optional UploadSink extension for sinks that can
+// delete an object they committed. MultipartForm uses it to clean up
+// objects that were fully streamed to the sink but ultimately couldn't be
+// used - an invalid map path, an unreferenced file, or one exceeding
+// MaxFileUploadSize - so a bad request doesn't leak storage.
+type UploadSinkRemover interface {
+	UploadSink
+
+	Remove(ctx context.Context, key string) error
+}
+
+// PresignedPutSink is an optional extension of UploadSink for sinks that can
+// hand clients a pre-signed PUT URL, letting very large files be uploaded
+// directly to storage without ever passing through the GraphQL server at
+// all. MultipartForm uses it when a request carries an
+// "X-Upload-Presign: 1" header.
+type PresignedPutSink interface {
+	UploadSink
+
+	// PresignPut returns a URL the client may PUT filename's bytes to
+	// directly, plus the key the object will be stored under once they do.
+	// The client is expected to replay the mutation afterwards with the
+	// returned key substituted into the upload's map field.
+	PresignPut(ctx context.Context, filename, contentType string) (url string, key string, err error)
+}
+
+// presignedUpload is the JSON shape returned for each file when a request
+// asked for pre-signed URLs instead of streaming the upload through us.
+type presignedUpload struct {
+	URL string `json:"uploadUrl"`
+	Key string `json:"key"`
+}
+
+// sinkFile lazily opens its backing object on first read, so that streaming
+// an upload straight to a sink never requires holding its bytes in the
+// GraphQL server's process. open() is synchronized so that concurrent
+// ReadAt calls - which graphql.Upload.File's contract explicitly allows,
+// and which is exactly how a resolver would hand this off to several
+// downstream consumers at once - can't race each other into calling
+// sink.Get twice or observing a half-initialized s.file.
+type sinkFile struct {
+	ctx  context.Context
+	sink UploadSink
+	key  string
+
+	mu   sync.Mutex
+	file multipart.File
+	err  error
+}
+
+func (s *sinkFile) open() (multipart.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		s.file, s.err = s.sink.Get(s.ctx, s.key)
+	}
+	return s.file, s.err
+}
+
+func (s *sinkFile) Read(p []byte) (int, error) {
+	f, err := s.open()
+	if err != nil {
+		return 0, err
+	}
+	return f.Read(p)
+}
+
+func (s *sinkFile) ReadAt(p []byte, off int64) (int, error) {
+	f, err := s.open()
+	if err != nil {
+		return 0, err
+	}
+	return f.ReadAt(p, off)
+}
+
+func (s *sinkFile) Seek(offset int64, whence int) (int64, error) {
+	f, err := s.open()
+	if err != nil {
+		return 0, err
+	}
+	return f.Seek(offset, whence)
+}
+
+func (s *sinkFile) Close() error {
+	s.mu.Lock()
+	f := s.file
+	s.mu.Unlock()
+	if f == nil {
+		return nil
+	}
+	return f.Close()
+}
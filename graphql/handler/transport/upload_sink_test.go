@@ -0,0 +1,143 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// countingSink wraps an in-memory object so sinkFile.open's Get calls can be
+// counted, to catch the double-Get that an unsynchronized open() allows
+// under concurrent access.
+type countingSink struct {
+	data  []byte
+	gets  int32
+	getAt func() error
+}
+
+func (s *countingSink) Put(ctx context.Context, filename, contentType string, src io.Reader) (string, int64, error) {
+	panic("not used by these tests")
+}
+
+func (s *countingSink) Get(ctx context.Context, key string) (multipart.File, error) {
+	atomic.AddInt32(&s.gets, 1)
+	if s.getAt != nil {
+		if err := s.getAt(); err != nil {
+			return nil, err
+		}
+	}
+	return memoryFile{Reader: bytes.NewReader(s.data)}, nil
+}
+
+func TestSinkFileReadsAfterLazyOpen(t *testing.T) {
+	sink := &countingSink{data: []byte("hello world")}
+	f := &sinkFile{ctx: context.Background(), sink: sink, key: "k"}
+
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll returned error: %v", err)
+	}
+	if string(got) != "hello world" {
+		t.Fatalf("content = %q, want %q", got, "hello world")
+	}
+	if sink.gets != 1 {
+		t.Fatalf("sink.Get called %d times, want 1", sink.gets)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+}
+
+func TestSinkFileSeekAndReadAt(t *testing.T) {
+	sink := &countingSink{data: []byte("0123456789")}
+	f := &sinkFile{ctx: context.Background(), sink: sink, key: "k"}
+	defer f.Close()
+
+	buf := make([]byte, 3)
+	n, err := f.ReadAt(buf, 5)
+	if err != nil {
+		t.Fatalf("ReadAt returned error: %v", err)
+	}
+	if n != 3 || string(buf) != "567" {
+		t.Fatalf("ReadAt = (%d, %q), want (3, %q)", n, buf, "567")
+	}
+
+	if _, err := f.Seek(2, io.SeekStart); err != nil {
+		t.Fatalf("Seek returned error: %v", err)
+	}
+	rest, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll after Seek returned error: %v", err)
+	}
+	if string(rest) != "23456789" {
+		t.Fatalf("content after Seek(2) = %q, want %q", rest, "23456789")
+	}
+}
+
+// TestSinkFileConcurrentReadAtOpensOnce drives many concurrent ReadAt calls
+// - the exact scenario multipart.File's ReadAt contract exists for, and the
+// one an async worker reading a handed-off upload would hit - through a
+// single sinkFile and checks sink.Get is only ever called once, instead of
+// racing into it from multiple goroutines.
+func TestSinkFileConcurrentReadAtOpensOnce(t *testing.T) {
+	sink := &countingSink{data: bytes.Repeat([]byte("x"), 1024)}
+	f := &sinkFile{ctx: context.Background(), sink: sink, key: "k"}
+	defer f.Close()
+
+	const goroutines = 50
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(off int64) {
+			defer wg.Done()
+			buf := make([]byte, 16)
+			if _, err := f.ReadAt(buf, off); err != nil {
+				t.Errorf("ReadAt returned error: %v", err)
+			}
+		}(int64(i % 64))
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&sink.gets); got != 1 {
+		t.Fatalf("sink.Get called %d times under concurrent ReadAt, want 1", got)
+	}
+}
+
+func TestSinkFileOpenErrorIsNotCached(t *testing.T) {
+	attempt := 0
+	sink := &countingSink{
+		data: []byte("ok"),
+		getAt: func() error {
+			attempt++
+			if attempt == 1 {
+				return errors.New("boom")
+			}
+			return nil
+		},
+	}
+	f := &sinkFile{ctx: context.Background(), sink: sink, key: "k"}
+
+	if _, err := f.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the first Read to surface the Get error")
+	}
+
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("second Read returned error: %v", err)
+	}
+	if string(got) != "ok" {
+		t.Fatalf("content = %q, want %q", got, "ok")
+	}
+}
+
+func TestSinkFileCloseBeforeOpenIsNoop(t *testing.T) {
+	f := &sinkFile{ctx: context.Background(), sink: &countingSink{}, key: "k"}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close on a never-opened sinkFile returned error: %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"os"
+	"sync"
+)
+
+// UploadStorage decides where the bytes of an uploaded file part end up once
+// MultipartForm has read them off the wire. It lets large uploads be spilled
+// to disk (or elsewhere) instead of living for the lifetime of the request
+// as a *multipart.Part tied to the HTTP body, which is neither seekable nor
+// safe to hand off to something that reads it later than the resolver that
+// received it.
+type UploadStorage interface {
+	// Store consumes data (a single multipart part, already limited to the
+	// relevant per-file size) and returns a handle that is independently
+	// readable, plus the number of bytes written. ctx is the operation
+	// context the upload is associated with; implementations that allocate
+	// resources needing cleanup (a temp file, an open fd, ...) should
+	// register them via RegisterUploadCleanup(ctx, ...) so they're released
+	// once the operation finishes. By default that happens when the
+	// transport's Do() returns; a resolver that needs the file to outlive
+	// the request (e.g. to hand it to an async worker) must call
+	// DetachUploadCleanup(ctx) before returning and take over removing it.
+	Store(ctx context.Context, filename, contentType string, data io.Reader) (multipart.File, int64, error)
+}
+
+// DefaultUploadStorage is the UploadStorage used by MultipartForm when none
+// is configured. It keeps a part in memory when the part is shorter than
+// MemoryBufferSize bytes; a part of MemoryBufferSize bytes or more is
+// written in full to a temp file created with os.CreateTemp, which is closed
+// and removed once the operation finishes (see RegisterUploadCleanup).
+type DefaultUploadStorage struct {
+	// MemoryBufferSize is the part size, in bytes, from which a part is
+	// written to disk instead of held in memory. Defaults to 32KB.
+	MemoryBufferSize int64
+}
+
+func (s DefaultUploadStorage) memoryBufferSize() int64 {
+	if s.MemoryBufferSize == 0 {
+		return 32 << 10
+	}
+	return s.MemoryBufferSize
+}
+
+func (s DefaultUploadStorage) Store(ctx context.Context, filename, contentType string, data io.Reader) (multipart.File, int64, error) {
+	threshold := s.memoryBufferSize()
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, data, threshold)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	if err == io.EOF {
+		// The whole part fit within the threshold, no need to touch disk.
+		return memoryFile{Reader: bytes.NewReader(buf.Bytes())}, n, nil
+	}
+
+	f, err := os.CreateTemp("", "gqlgen-upload-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	// f stays open for the rest of the request (it's also the handle reads
+	// come from), so it's registered here rather than closed immediately;
+	// the cleanup func closes and removes it once the operation is done.
+	RegisterUploadCleanup(ctx, f.Name(), f)
+
+	written, err := io.Copy(f, io.MultiReader(bytes.NewReader(buf.Bytes()), data))
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+
+	return f, written, nil
+}
+
+// memoryFile adapts a bytes.Reader to multipart.File so small uploads never
+// need a temp file.
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (memoryFile) Close() error { return nil }
+
+type uploadCleanupKey struct{}
+
+// uploadCleanupEntry is a single resource registered with RegisterUploadCleanup:
+// a temp file path to remove and, if the handle that wrote it is still open,
+// the io.Closer to close first.
+type uploadCleanupEntry struct {
+	path   string
+	closer io.Closer
+}
+
+// uploadCleanup tracks the resources allocated for a single operation's
+// uploads so they can be released once the operation (and any resolvers
+// reading from them) have finished - or handed off via DetachUploadCleanup
+// to something that outlives the request.
+type uploadCleanup struct {
+	mu      sync.Mutex
+	entries []uploadCleanupEntry
+}
+
+func (c *uploadCleanup) release() {
+	c.mu.Lock()
+	entries := c.entries
+	c.entries = nil
+	c.mu.Unlock()
+
+	for _, e := range entries {
+		if e.closer != nil {
+			e.closer.Close()
+		}
+		if e.path != "" {
+			os.Remove(e.path)
+		}
+	}
+}
+
+// WithUploadCleanup returns a context that RegisterUploadCleanup can attach
+// upload resources to, along with a func that releases them all. Transports
+// that use UploadStorage should call this once per operation and defer the
+// returned func after the operation has been fully dispatched.
+func WithUploadCleanup(ctx context.Context) (context.Context, func()) {
+	c := &uploadCleanup{}
+	return context.WithValue(ctx, uploadCleanupKey{}, c), c.release
+}
+
+// RegisterUploadCleanup records a temp file to be removed when the func
+// returned by WithUploadCleanup runs, closing closer first if it isn't nil -
+// needed because on Linux, removing a file whose descriptor is still open
+// frees neither the fd nor its disk blocks. It is a no-op if ctx was not
+// derived from WithUploadCleanup, which keeps UploadStorage implementations
+// usable outside of MultipartForm too.
+func RegisterUploadCleanup(ctx context.Context, path string, closer io.Closer) {
+	if c, ok := ctx.Value(uploadCleanupKey{}).(*uploadCleanup); ok {
+		c.mu.Lock()
+		c.entries = append(c.entries, uploadCleanupEntry{path: path, closer: closer})
+		c.mu.Unlock()
+	}
+}
+
+// DetachUploadCleanup opts an operation's uploads out of the automatic
+// cleanup that would otherwise run the instant the transport's Do() returns,
+// and hands that responsibility to the caller instead. Without this, a
+// resolver can't pass graphql.Upload.File on to an asynchronous worker: the
+// temp file backing it would be removed before the worker got a chance to
+// read it. Call it from a resolver before returning, then call the returned
+// func once the detached files are actually no longer needed.
+//
+// It is a no-op (returning a func that does nothing) if ctx was not derived
+// from WithUploadCleanup.
+func DetachUploadCleanup(ctx context.Context) func() {
+	c, ok := ctx.Value(uploadCleanupKey{}).(*uploadCleanup)
+	if !ok {
+		return func() {}
+	}
+
+	c.mu.Lock()
+	entries := c.entries
+	c.entries = nil
+	c.mu.Unlock()
+
+	detached := &uploadCleanup{entries: entries}
+	return detached.release
+}
@@ -0,0 +1,126 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDefaultUploadStorageKeepsSmallUploadsInMemory(t *testing.T) {
+	storage := DefaultUploadStorage{MemoryBufferSize: 16}
+	ctx, release := WithUploadCleanup(context.Background())
+	defer release()
+
+	data := strings.Repeat("a", 10)
+	file, size, err := storage.Store(ctx, "small.txt", "text/plain", strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("Store returned error: %v", err)
+	}
+	defer file.Close()
+
+	if size != int64(len(data)) {
+		t.Fatalf("size = %d, want %d", size, len(data))
+	}
+	if _, ok := file.(memoryFile); !ok {
+		t.Fatalf("file has type %T, want memoryFile: an upload under the threshold shouldn't touch disk", file)
+	}
+
+	got, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("ReadAll returned error: %v", err)
+	}
+	if string(got) != data {
+		t.Fatalf("read content %q, want %q", got, data)
+	}
+}
+
+func TestDefaultUploadStorageSpillsLargeUploadsToDisk(t *testing.T) {
+	storage := DefaultUploadStorage{MemoryBufferSize: 4}
+	ctx, release := WithUploadCleanup(context.Background())
+
+	data := strings.Repeat("b", 100)
+	file, size, err := storage.Store(ctx, "large.txt", "text/plain", strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("Store returned error: %v", err)
+	}
+
+	if size != int64(len(data)) {
+		t.Fatalf("size = %d, want %d", size, len(data))
+	}
+	osFile, ok := file.(*os.File)
+	if !ok {
+		t.Fatalf("file has type %T, want *os.File: an upload over the threshold should spill to disk", file)
+	}
+	path := osFile.Name()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("temp file %s does not exist: %v", path, err)
+	}
+
+	got, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("ReadAll returned error: %v", err)
+	}
+	if string(got) != data {
+		t.Fatalf("read content length %d, want %d", len(got), len(data))
+	}
+
+	// release() should close the fd and remove the backing file - the
+	// leak this test guards against.
+	release()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("temp file %s still exists after release(): %v", path, err)
+	}
+	if err := osFile.Close(); err == nil {
+		t.Fatal("expected the temp file's fd to already be closed by release(), but Close succeeded")
+	}
+}
+
+func TestDetachUploadCleanupSurvivesOriginalRelease(t *testing.T) {
+	storage := DefaultUploadStorage{MemoryBufferSize: 4}
+	ctx, release := WithUploadCleanup(context.Background())
+
+	file, _, err := storage.Store(ctx, "large.txt", "text/plain", strings.NewReader(strings.Repeat("c", 100)))
+	if err != nil {
+		t.Fatalf("Store returned error: %v", err)
+	}
+	osFile, ok := file.(*os.File)
+	if !ok {
+		t.Fatalf("file has type %T, want *os.File: an upload over the threshold should spill to disk", file)
+	}
+	path := osFile.Name()
+
+	detachedRelease := DetachUploadCleanup(ctx)
+
+	// The original release, run as if Do() had already returned, must not
+	// touch the detached upload - that's the whole point of detaching it
+	// for a resolver handing the file to an async worker.
+	release()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("detached temp file %s was removed by the original release(): %v", path, err)
+	}
+
+	_, _, err = storage.Store(ctx, "canary.txt", "text/plain", strings.NewReader(strings.Repeat("d", 100)))
+	if err != nil {
+		t.Fatalf("Store after release returned error: %v", err)
+	}
+	defer release() // cleans up the canary upload registered after the first release
+
+	detachedRelease()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("detached temp file %s still exists after the detached release: %v", path, err)
+	}
+}
+
+func TestDetachUploadCleanupNoopOutsideUploadCleanupContext(t *testing.T) {
+	release := DetachUploadCleanup(context.Background())
+	release() // must not panic
+}
+
+func TestRegisterUploadCleanupNoopOutsideUploadCleanupContext(t *testing.T) {
+	// Must not panic even though ctx was never derived from
+	// WithUploadCleanup - UploadStorage implementations need to stay usable
+	// outside of MultipartForm.
+	RegisterUploadCleanup(context.Background(), "/does/not/matter", nil)
+}